@@ -0,0 +1,407 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const numSlots = 16384
+
+// maxRedirects bounds how many times Do will follow a MOVED/ASK reply
+// for a single command. A disagreement between the caller's slot map
+// and the cluster's actual layout (e.g. mid-resharding, or straddling a
+// partition) could otherwise bounce a command between two nodes
+// forever.
+const maxRedirects = 16
+
+var errNoClusterNodes = errors.New("redis: no reachable cluster nodes")
+
+// clusterNode is one master in the cluster along with its own conn
+// pool. clusterPool keeps one of these per distinct address it routes
+// to: masters named by CLUSTER SLOTS or a MOVED/ASK reply, and a seed
+// address when Get runs before any node is known.
+type clusterNode struct {
+	addr string
+	pool *connPool
+}
+
+// clusterPool is a pool implementation keyed by the 16384 Redis Cluster
+// hash slots rather than a single upstream. It discovers the slot
+// layout with CLUSTER SLOTS and keeps one connPool per master node,
+// routing GetForKey by the CRC16 slot of the key (honoring {hashtag}
+// substrings). MOVED/ASK redirects are resolved via Redirect, which the
+// command-dispatch layer calls after it sees one of those replies.
+type clusterPool struct {
+	seedAddrs []string
+	dial      func(addr string) (net.Conn, error)
+
+	maxSize     int
+	idleTimeout time.Duration
+
+	mu     sync.RWMutex
+	nodes  map[string]*clusterNode
+	slots  [numSlots]*clusterNode
+	loaded bool
+}
+
+func newClusterPool(
+	seedAddrs []string,
+	dial func(addr string) (net.Conn, error),
+	maxSize int,
+	idleTimeout time.Duration,
+) *clusterPool {
+	return &clusterPool{
+		seedAddrs:   seedAddrs,
+		dial:        dial,
+		maxSize:     maxSize,
+		idleTimeout: idleTimeout,
+		nodes:       make(map[string]*clusterNode),
+	}
+}
+
+func (p *clusterPool) nodeForAddr(addr string) *clusterNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n, ok := p.nodes[addr]; ok {
+		return n
+	}
+	n := &clusterNode{addr: addr}
+	n.pool = newConnPool(newConnFunc(func() (net.Conn, error) {
+		return p.dial(addr)
+	}), p.maxSize, p.idleTimeout, poolOptions{})
+	p.nodes[addr] = n
+	return n
+}
+
+func (p *clusterPool) knownAddrs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.nodes) == 0 {
+		return p.seedAddrs
+	}
+	addrs := make([]string, 0, len(p.nodes))
+	for addr := range p.nodes {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// reloadSlots runs CLUSTER SLOTS against any known node and rebuilds
+// the slot -> node table.
+func (p *clusterPool) reloadSlots() error {
+	var lastErr error
+	for _, addr := range p.knownAddrs() {
+		cn, err := p.dial(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ranges, err := clusterSlots(cn)
+		cn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var table [numSlots]*clusterNode
+		for _, r := range ranges {
+			node := p.nodeForAddr(r.addr)
+			for slot := r.start; slot <= r.end; slot++ {
+				table[slot] = node
+			}
+		}
+
+		p.mu.Lock()
+		p.slots = table
+		p.loaded = true
+		p.mu.Unlock()
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errNoClusterNodes
+	}
+	return lastErr
+}
+
+// GetForKey returns a conn to the master serving key's slot, loading
+// the slot map on first use.
+func (p *clusterPool) GetForKey(ctx context.Context, key []byte) (*conn, bool, error) {
+	p.mu.RLock()
+	loaded := p.loaded
+	p.mu.RUnlock()
+	if !loaded {
+		if err := p.reloadSlots(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	slot := keySlot(key)
+	p.mu.RLock()
+	node := p.slots[slot]
+	p.mu.RUnlock()
+	if node == nil {
+		return nil, false, fmt.Errorf("redis: slot %d has no known owner", slot)
+	}
+	return node.pool.Get(ctx)
+}
+
+// Redirect resolves a single MOVED (moved=true) or ASK (moved=false)
+// reply: MOVED permanently repoints slot at addr, ASK just forwards
+// this one command via an ASKING handshake on addr without touching the
+// slot map. It returns a fresh conn to retry the command on. Redirect
+// only resolves one hop - Do is the bounded caller that loops on it up
+// to maxRedirects times for a single command.
+func (p *clusterPool) Redirect(ctx context.Context, slot int, addr string, moved bool) (*conn, bool, error) {
+	node := p.nodeForAddr(addr)
+	if moved {
+		p.mu.Lock()
+		p.slots[slot] = node
+		p.mu.Unlock()
+	}
+
+	cn, isNew, err := node.pool.Get(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if !moved {
+		if err := writeCmd(cn.cn, "ASKING"); err != nil {
+			node.pool.Remove(cn)
+			return nil, false, err
+		}
+		if _, err := readReply(bufio.NewReader(cn.cn)); err != nil {
+			node.pool.Remove(cn)
+			return nil, false, err
+		}
+	}
+	return cn, isNew, nil
+}
+
+// Do runs a single command against the node owning key's slot,
+// following up to maxRedirects MOVED/ASK redirects before giving up.
+// MOVED/ASK arrive as ordinary RESP error replies, so the conn that
+// received one is still protocol-healthy and goes back to its node's
+// pool before Do moves on to the redirect target; any other error is
+// treated as the conn itself being broken and it's removed instead.
+func (p *clusterPool) Do(ctx context.Context, key []byte, args ...string) (interface{}, error) {
+	cn, _, err := p.GetForKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; ; i++ {
+		reply, err := doOnce(cn, args)
+		if err == nil {
+			if err := p.Put(cn); err != nil {
+				return reply, err
+			}
+			return reply, nil
+		}
+
+		addr, moved, ok := parseRedirectErr(err)
+		if !ok {
+			p.Remove(cn)
+			return nil, err
+		}
+		if err := p.Put(cn); err != nil {
+			return nil, err
+		}
+		if i >= maxRedirects {
+			return nil, fmt.Errorf("redis: too many redirects for key %q: %s", key, err)
+		}
+
+		cn, _, err = p.Redirect(ctx, keySlot(key), addr, moved)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func doOnce(cn *conn, args []string) (interface{}, error) {
+	if err := writeCmd(cn, args...); err != nil {
+		return nil, err
+	}
+	return readReply(bufio.NewReader(cn))
+}
+
+// parseRedirectErr reports whether err is a MOVED or ASK reply and, if
+// so, the node address it points at.
+func parseRedirectErr(err error) (addr string, moved bool, ok bool) {
+	fields := strings.Fields(err.Error())
+	if len(fields) != 3 {
+		return "", false, false
+	}
+	switch fields[0] {
+	case "MOVED":
+		return fields[2], true, true
+	case "ASK":
+		return fields[2], false, true
+	default:
+		return "", false, false
+	}
+}
+
+func (p *clusterPool) nodeForConn(cn *conn) *clusterNode {
+	addr := cn.cn.RemoteAddr().String()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.nodes[addr]
+}
+
+// Get satisfies the pool interface by routing to an arbitrary node;
+// callers that care which node a command goes to should use
+// GetForKey instead.
+func (p *clusterPool) Get(ctx context.Context) (*conn, bool, error) {
+	addrs := p.knownAddrs()
+	if len(addrs) == 0 {
+		return nil, false, errNoClusterNodes
+	}
+	return p.nodeForAddr(addrs[0]).pool.Get(ctx)
+}
+
+func (p *clusterPool) Put(cn *conn) error {
+	if node := p.nodeForConn(cn); node != nil {
+		return node.pool.Put(cn)
+	}
+	return cn.Close()
+}
+
+func (p *clusterPool) Remove(cn *conn) error {
+	if node := p.nodeForConn(cn); node != nil {
+		return node.pool.Remove(cn)
+	}
+	return cn.Close()
+}
+
+func (p *clusterPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	n := 0
+	for _, node := range p.nodes {
+		n += node.pool.Len()
+	}
+	return n
+}
+
+func (p *clusterPool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	n := 0
+	for _, node := range p.nodes {
+		n += node.pool.Size()
+	}
+	return n
+}
+
+func (p *clusterPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var retErr error
+	for _, node := range p.nodes {
+		if err := node.pool.Close(); err != nil {
+			retErr = err
+		}
+	}
+	return retErr
+}
+
+//------------------------------------------------------------------------------
+
+type slotRange struct {
+	start, end int
+	addr       string
+}
+
+// clusterSlots issues CLUSTER SLOTS on cn and parses the slot ranges
+// and master addresses out of the reply.
+func clusterSlots(cn net.Conn) ([]slotRange, error) {
+	if err := writeCmd(cn, "CLUSTER", "SLOTS"); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(bufio.NewReader(cn))
+	if err != nil {
+		return nil, err
+	}
+	entries, ok := reply.([]interface{})
+	if !ok {
+		return nil, errBadReply
+	}
+
+	ranges := make([]slotRange, 0, len(entries))
+	for _, e := range entries {
+		fields, ok := e.([]interface{})
+		if !ok || len(fields) < 3 {
+			continue
+		}
+		start, ok1 := fields[0].(int64)
+		end, ok2 := fields[1].(int64)
+		master, ok3 := fields[2].([]interface{})
+		if !ok1 || !ok2 || !ok3 || len(master) < 2 {
+			continue
+		}
+		host, _ := master[0].(string)
+		port, _ := master[1].(int64)
+		if host == "" || port == 0 {
+			continue
+		}
+		ranges = append(ranges, slotRange{
+			start: int(start),
+			end:   int(end),
+			addr:  net.JoinHostPort(host, fmt.Sprintf("%d", port)),
+		})
+	}
+	return ranges, nil
+}
+
+// keySlot computes the Redis Cluster hash slot for key, using the
+// substring inside the first {...} hashtag when present.
+func keySlot(key []byte) int {
+	if tag := hashtag(key); tag != nil {
+		key = tag
+	}
+	return int(crc16(key)) % numSlots
+}
+
+func hashtag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return nil
+	}
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return nil
+	}
+	return key[start+1 : start+1+end]
+}
+
+var crc16Table = func() [256]uint16 {
+	const poly = 0x1021
+	var tbl [256]uint16
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		tbl[i] = crc
+	}
+	return tbl
+}()
+
+// crc16 is the CRC16-CCITT variant Redis Cluster uses for slot hashing.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = (crc << 8) ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,61 @@
+package redis
+
+import "testing"
+
+func TestHashtag(t *testing.T) {
+	cases := []struct {
+		key  string
+		want string
+	}{
+		{"foo", ""},
+		{"{foo}", "foo"},
+		{"{foo}.bar", "foo"},
+		{"foo{bar}baz", "bar"},
+		{"foo{}bar", ""},
+		{"foo{bar", ""},
+		{"{}", ""},
+	}
+	for _, c := range cases {
+		got := hashtag([]byte(c.key))
+		if string(got) != c.want {
+			t.Errorf("hashtag(%q) = %q, want %q", c.key, got, c.want)
+		}
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	// Known-answer vectors from the Redis Cluster spec's reference CRC16
+	// implementation.
+	cases := []struct {
+		key  string
+		want uint16
+	}{
+		{"", 0x0000},
+		{"123456789", 0x31C3},
+	}
+	for _, c := range cases {
+		if got := crc16([]byte(c.key)); got != c.want {
+			t.Errorf("crc16(%q) = %#04x, want %#04x", c.key, got, c.want)
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	// Keys sharing a {hashtag} must land on the same slot regardless of
+	// what surrounds the tag.
+	a := keySlot([]byte("{user1000}.following"))
+	b := keySlot([]byte("{user1000}.followers"))
+	if a != b {
+		t.Errorf("keySlot with shared hashtag diverged: %d != %d", a, b)
+	}
+
+	if slot := keySlot([]byte("123456789")); slot != int(0x31C3)%numSlots {
+		t.Errorf("keySlot(%q) = %d, want %d", "123456789", slot, int(0x31C3)%numSlots)
+	}
+
+	for _, key := range [][]byte{[]byte("a"), []byte("foo"), []byte("{tag}rest")} {
+		if slot := keySlot(key); slot < 0 || slot >= numSlots {
+			t.Errorf("keySlot(%q) = %d, out of range [0, %d)", key, slot, numSlots)
+		}
+	}
+}
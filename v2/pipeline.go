@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PipelineCmd is one command to run as part of a Pipeline. Key is only
+// used to pick a target node when the pipeline runs against a
+// clusterPool; a single-node Pipeline ignores it.
+type PipelineCmd struct {
+	Key  []byte
+	Args []string
+}
+
+// PipelineReply is the result of running one PipelineCmd, at the same
+// index as the PipelineCmd it came from.
+type PipelineReply struct {
+	Reply interface{}
+	Err   error
+}
+
+// Pipeline checks out up to len(cmds) conns from pool via GetN (bounded
+// by maxSize; on a saturated pool with a PoolTimeout it goes on with
+// fewer conns, while without a PoolTimeout it waits on ctx for each
+// conn it asks for), spreads cmds round-robin across them, and runs
+// each conn's share of the batch concurrently with the others while
+// keeping per-conn commands in order. Replies come back in the same
+// order as cmds. A conn whose share is cut short by ctx is left with
+// its RESP stream mid-command or mid-reply, so it's marked stale before
+// the deferred PutN returns it, and goes to Remove instead of the idle
+// list.
+func Pipeline(ctx context.Context, pool *connPool, cmds []PipelineCmd) ([]PipelineReply, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	conns, err := pool.GetN(ctx, len(cmds))
+	if err != nil {
+		// GetN can return a non-empty partial batch alongside an error
+		// that isn't ErrPoolTimeout (ctx canceled, pool closed); put back
+		// whatever it did hand out before reporting the error.
+		pool.PutN(conns)
+		return nil, err
+	}
+	defer pool.PutN(conns)
+
+	buckets := make([][]int, len(conns))
+	for i := range cmds {
+		b := i % len(conns)
+		buckets[b] = append(buckets[b], i)
+	}
+
+	replies := make([]PipelineReply, len(cmds))
+	var wg sync.WaitGroup
+	for b, idxs := range buckets {
+		if len(idxs) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(cn *conn, idxs []int) {
+			defer wg.Done()
+
+			// writeCmd/readReply go through cn, not the raw cn.cn, so
+			// they honor cn.writeTimeout/readTimeout. ctx cancellation
+			// can't interrupt a blocked net.Conn directly, so a watcher
+			// forces the deadline to now if ctx finishes first, which
+			// unblocks any pending Read/Write with a timeout error.
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				select {
+				case <-ctx.Done():
+					cn.cn.SetDeadline(time.Now())
+				case <-done:
+				}
+			}()
+			defer func() {
+				close(done)
+				<-stopped
+				// The watcher can cut short the share's last command,
+				// which the per-command check below never sees.
+				if ctx.Err() != nil {
+					cn.stale = true
+				}
+			}()
+
+			r := bufio.NewReader(cn)
+			for _, i := range idxs {
+				select {
+				case <-ctx.Done():
+					// cn may have a command half-written or a reply
+					// half-read on the wire at this point, so it can't
+					// be trusted back into the idle list: mark it stale
+					// the same way a Sentinel failover does, so the
+					// deferred PutN routes it to Remove instead.
+					cn.stale = true
+					replies[i] = PipelineReply{Err: ctx.Err()}
+					continue
+				default:
+				}
+				if err := writeCmd(cn, cmds[i].Args...); err != nil {
+					replies[i] = PipelineReply{Err: err}
+					continue
+				}
+				reply, err := readReply(r)
+				replies[i] = PipelineReply{Reply: reply, Err: err}
+			}
+		}(conns[b], idxs)
+	}
+	wg.Wait()
+
+	return replies, nil
+}
+
+// ClusterPipeline groups cmds by the cluster node that owns each cmd's
+// Key slot and runs one Pipeline per node concurrently, so the keys of a
+// cross-slot MGET/MSET are worked on by all their nodes at once, each
+// node's share spread over that node's conns. Each conn still sends one
+// command and reads its reply before sending the next.
+// Replies come back in the same order as cmds.
+func (p *clusterPool) ClusterPipeline(ctx context.Context, cmds []PipelineCmd) ([]PipelineReply, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	p.mu.RLock()
+	loaded := p.loaded
+	p.mu.RUnlock()
+	if !loaded {
+		if err := p.reloadSlots(); err != nil {
+			return nil, err
+		}
+	}
+
+	byNode := make(map[*clusterNode][]int)
+	for i, cmd := range cmds {
+		slot := keySlot(cmd.Key)
+		p.mu.RLock()
+		node := p.slots[slot]
+		p.mu.RUnlock()
+		if node == nil {
+			return nil, fmt.Errorf("redis: slot %d has no known owner", slot)
+		}
+		byNode[node] = append(byNode[node], i)
+	}
+
+	replies := make([]PipelineReply, len(cmds))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for node, idxs := range byNode {
+		wg.Add(1)
+		go func(node *clusterNode, idxs []int) {
+			defer wg.Done()
+
+			nodeCmds := make([]PipelineCmd, len(idxs))
+			for j, i := range idxs {
+				nodeCmds[j] = cmds[i]
+			}
+
+			nodeReplies, err := Pipeline(ctx, node.pool, nodeCmds)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			for j, i := range idxs {
+				replies[i] = nodeReplies[j]
+			}
+		}(node, idxs)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return replies, nil
+}
@@ -1,22 +1,29 @@
 package redis
 
 import (
+	"bufio"
 	"container/list"
+	"context"
 	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/vmihailenco/bufio"
+	vbufio "github.com/vmihailenco/bufio"
 )
 
 var (
 	errPoolClosed = errors.New("attempt to use closed connection pool")
+
+	// ErrPoolTimeout is returned by Get when PoolTimeout elapses before a
+	// connection becomes available.
+	ErrPoolTimeout = errors.New("redis: connection pool timeout")
 )
 
 type pool interface {
-	Get() (*conn, bool, error)
+	Get(ctx context.Context) (*conn, bool, error)
 	Put(*conn) error
 	Remove(*conn) error
 	Len() int
@@ -27,13 +34,20 @@ type pool interface {
 //------------------------------------------------------------------------------
 
 type conn struct {
-	cn     net.Conn
-	rd     reader
-	inUse  bool
-	usedAt time.Time
+	cn        net.Conn
+	rd        reader
+	inUse     bool
+	usedAt    time.Time
+	createdAt time.Time
 
 	readTimeout, writeTimeout time.Duration
 
+	// stale is set by a pool that discovers, while this conn is checked
+	// out, that it no longer points at a usable node (e.g. a Sentinel
+	// failover). Put() closes the conn instead of returning it to the
+	// idle list.
+	stale bool
+
 	elem *list.Element
 }
 
@@ -45,13 +59,28 @@ func newConnFunc(dial func() (net.Conn, error)) func() (*conn, error) {
 		}
 
 		cn := &conn{
-			cn: netcn,
+			cn:        netcn,
+			createdAt: time.Now(),
 		}
-		cn.rd = bufio.NewReader(cn)
+		cn.rd = vbufio.NewReader(cn)
 		return cn, nil
 	}
 }
 
+// ping issues a lightweight PING on cn, bypassing its normal buffered
+// reader, and reports whether the server answered in time. Used by the
+// pool's health-check reaper to evict dead idle conns.
+func (cn *conn) ping(timeout time.Duration) error {
+	cn.cn.SetDeadline(time.Now().Add(timeout))
+	defer cn.cn.SetDeadline(time.Time{})
+
+	if err := writeCmd(cn.cn, "PING"); err != nil {
+		return err
+	}
+	_, err := readReply(bufio.NewReader(cn.cn))
+	return err
+}
+
 func (cn *conn) Read(b []byte) (int, error) {
 	if cn.readTimeout != 0 {
 		cn.cn.SetReadDeadline(time.Now().Add(cn.readTimeout))
@@ -76,148 +105,469 @@ func (cn *conn) Close() error {
 
 //------------------------------------------------------------------------------
 
+// poolOptions bundles the less commonly tuned connPool knobs, on top
+// of the bare dialer/maxSize/idleTimeout every pool needs.
+type poolOptions struct {
+	// HealthCheckInterval, if > 0, starts a background reaper that
+	// evicts idle conns past idleTimeout or MaxConnAge and PINGs the
+	// rest, evicting any that fail to answer.
+	HealthCheckInterval time.Duration
+
+	// MaxConnAge, if > 0, caps how long a single conn may live
+	// regardless of how recently it was used.
+	MaxConnAge time.Duration
+
+	// MinIdleConns, if > 0, is the floor the reaper redials up to after
+	// evictions, so callers don't pay a cold-start latency spike.
+	MinIdleConns int
+
+	// PoolTimeout bounds how long Get will wait for a connection slot to
+	// free up before returning ErrPoolTimeout. Zero means wait as long
+	// as the caller's context allows.
+	PoolTimeout time.Duration
+}
+
+// PoolStats reports point-in-time counters for a connPool, for
+// exporting to whatever metrics system the caller uses.
+type PoolStats struct {
+	Hits       uint64 // conns served from the idle list
+	Misses     uint64 // conns dialed because none were idle
+	Timeouts   uint64 // Get calls that returned ErrPoolTimeout
+	StaleConns uint64 // idle conns evicted by the health-check reaper
+}
+
 type connPool struct {
 	New func() (*conn, error)
 
-	cond  *sync.Cond
+	mu    sync.Mutex
 	conns *list.List
 
+	// queue is a semaphore with one buffered slot per maxSize: Get takes
+	// a slot when it dials (waiting on ctx/PoolTimeout if none is free)
+	// and the slot is given back only when a conn leaves the pool
+	// (Remove and the evictions); Put keeps it. It bounds how many conns
+	// - idle or checked out - the pool will maintain at once, and replaces the old unbounded
+	// sync.Cond wait with something ctx.Done() and a timer can select on.
+	queue chan struct{}
+
 	len         int
 	maxSize     int
 	idleTimeout time.Duration
+	maxConnAge  time.Duration
+
+	minIdleConns int
+	poolTimeout  time.Duration
+
+	stats PoolStats
 
-	closed bool
+	closed     bool
+	reaperStop chan struct{}
 }
 
 func newConnPool(
 	dial func() (*conn, error),
 	maxSize int,
 	idleTimeout time.Duration,
+	opt poolOptions,
 ) *connPool {
-	return &connPool{
+	p := &connPool{
 		New: dial,
 
-		cond:  sync.NewCond(&sync.Mutex{}),
 		conns: list.New(),
+		queue: make(chan struct{}, maxSize),
 
 		maxSize:     maxSize,
 		idleTimeout: idleTimeout,
+		maxConnAge:  opt.MaxConnAge,
+
+		minIdleConns: opt.MinIdleConns,
+		poolTimeout:  opt.PoolTimeout,
+
+		reaperStop: make(chan struct{}),
+	}
+	for i := 0; i < maxSize; i++ {
+		p.queue <- struct{}{}
+	}
+	if opt.HealthCheckInterval > 0 {
+		go p.reaper(opt.HealthCheckInterval)
+	}
+	return p
+}
+
+// waitToken blocks until a pool slot is free, ctx is done, or
+// poolTimeout elapses, whichever comes first.
+func (p *connPool) waitToken(ctx context.Context) error {
+	if p.poolTimeout > 0 {
+		timer := time.NewTimer(p.poolTimeout)
+		defer timer.Stop()
+		select {
+		case <-p.queue:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			atomic.AddUint64(&p.stats.Timeouts, 1)
+			return ErrPoolTimeout
+		}
+	}
+
+	select {
+	case <-p.queue:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (p *connPool) Get() (*conn, bool, error) {
-	p.cond.L.Lock()
+// freeToken gives back a slot taken by waitToken or by the reaper's
+// best-effort top-up.
+func (p *connPool) freeToken() {
+	p.queue <- struct{}{}
+}
+
+// tryToken takes a slot without blocking, for the reaper's best-effort
+// top-up; it returns false if the pool is already at maxSize.
+func (p *connPool) tryToken() bool {
+	select {
+	case <-p.queue:
+		return true
+	default:
+		return false
+	}
+}
+
+// PoolStats returns a snapshot of the pool's hit/miss/timeout/eviction
+// counters.
+func (p *connPool) PoolStats() *PoolStats {
+	return &PoolStats{
+		Hits:       atomic.LoadUint64(&p.stats.Hits),
+		Misses:     atomic.LoadUint64(&p.stats.Misses),
+		Timeouts:   atomic.LoadUint64(&p.stats.Timeouts),
+		StaleConns: atomic.LoadUint64(&p.stats.StaleConns),
+	}
+}
+
+// reaper periodically health-checks idle conns until the pool is
+// closed.
+func (p *connPool) reaper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.reaperStop:
+			return
+		case <-ticker.C:
+			p.reapIdleConns()
+		}
+	}
+}
+
+const pingTimeout = time.Second
+
+// reapIdleConns closes idle conns that exceeded idleTimeout or
+// maxConnAge, PINGs the survivors and evicts any that fail to answer,
+// then redials up to minIdleConns to avoid a cold-start spike on the
+// next Get.
+func (p *connPool) reapIdleConns() {
+	p.mu.Lock()
+	if p.closed {
+		// A tick can race with Close; Close has already closed every
+		// conn and dropped the list.
+		p.mu.Unlock()
+		return
+	}
+	var dead []*conn
+	var checking []*conn
+	e := p.conns.Front()
+	for e != nil {
+		next := e.Next()
+		cn := e.Value.(*conn)
+		if cn.inUse {
+			break
+		}
+		if (p.idleTimeout > 0 && time.Since(cn.usedAt) > p.idleTimeout) ||
+			(p.maxConnAge > 0 && time.Since(cn.createdAt) > p.maxConnAge) {
+			p.conns.Remove(e)
+			cn.elem = nil
+			p.len--
+			dead = append(dead, cn)
+		} else {
+			// Check cn out exactly like a real Get, so it moves to the
+			// back of the idle list and getIdle can't hand it to a
+			// caller while we PING it below with the lock released.
+			cn.inUse = true
+			p.conns.MoveToBack(e)
+			p.len--
+			checking = append(checking, cn)
+		}
+		e = next
+	}
+	p.mu.Unlock()
+
+	for _, cn := range dead {
+		if err := cn.Close(); err != nil {
+			glog.Errorf("redis: reaper: cn.Close failed: %s", err)
+		}
+		p.freeToken()
+	}
+	atomic.AddUint64(&p.stats.StaleConns, uint64(len(dead)))
+
+	survived := 0
+	for _, cn := range checking {
+		if err := cn.ping(pingTimeout); err != nil {
+			if err := p.Remove(cn); err != nil {
+				glog.Errorf("redis: reaper: Remove failed: %s", err)
+			}
+			atomic.AddUint64(&p.stats.StaleConns, 1)
+			continue
+		}
+		// Put puts cn back exactly where a checked-out conn would land,
+		// so a Get that was waiting on it sees it the moment we're done
+		// PINGing rather than for the whole reap pass.
+		if err := p.Put(cn); err != nil {
+			glog.Errorf("redis: reaper: Put failed: %s", err)
+			continue
+		}
+		survived++
+	}
+
+	need := p.minIdleConns - survived
+	for i := 0; i < need; i++ {
+		if !p.tryToken() {
+			// Pool is already saturated with checked-out conns; leave
+			// the floor unfilled rather than exceeding maxSize.
+			break
+		}
+
+		cn, err := p.New()
+		if err != nil {
+			glog.Errorf("redis: reaper: dial failed: %s", err)
+			p.freeToken()
+			break
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			cn.Close()
+			p.freeToken()
+			break
+		}
+		cn.usedAt = time.Now()
+		cn.elem = p.conns.PushFront(cn)
+		p.len++
+		p.mu.Unlock()
+	}
+}
+
+// Get returns an idle conn if one is available, or dials a new one,
+// waiting for a free pool slot if the pool is already at maxSize. It
+// gives up and returns ctx.Err() if ctx is done first, or ErrPoolTimeout
+// if PoolTimeout elapses first.
+//
+// A token is only taken from queue for the dial path: reusing an idle
+// conn doesn't grow the pool, so it doesn't need one. Put never frees a
+// token for the same reason - tokens are only freed when a conn is
+// actually removed from the pool (Remove, idle-timeout eviction, the
+// reaper, a Sentinel failover), mirroring the one taken here on dial.
+func (p *connPool) Get(ctx context.Context) (*conn, bool, error) {
+	cn, ok, err := p.getIdle()
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		atomic.AddUint64(&p.stats.Hits, 1)
+		return cn, false, nil
+	}
+
+	if err := p.waitToken(ctx); err != nil {
+		return nil, false, err
+	}
+
+	// Someone may have returned a conn to the idle list while we were
+	// waiting for a token; prefer it over dialing a redundant new one.
+	cn, ok, err = p.getIdle()
+	if err != nil {
+		p.freeToken()
+		return nil, false, err
+	}
+	if ok {
+		p.freeToken()
+		atomic.AddUint64(&p.stats.Hits, 1)
+		return cn, false, nil
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.freeToken()
+		return nil, false, errPoolClosed
+	}
+
+	cn, err = p.New()
+	if err != nil {
+		p.mu.Unlock()
+		p.freeToken()
+		return nil, false, err
+	}
+
+	cn.inUse = true
+	cn.elem = p.conns.PushBack(cn)
+
+	p.mu.Unlock()
+	atomic.AddUint64(&p.stats.Misses, 1)
+	return cn, true, nil
+}
+
+// getIdle prunes conns past idleTimeout and, if one remains, checks it
+// out. The bool return is false (with a nil error) when the pool has
+// no usable idle conn right now, not when something went wrong.
+func (p *connPool) getIdle() (*conn, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	if p.closed {
-		p.cond.L.Unlock()
 		return nil, false, errPoolClosed
 	}
 
 	if p.idleTimeout > 0 {
-		for e := p.conns.Front(); e != nil; e = e.Next() {
+		e := p.conns.Front()
+		for e != nil {
+			next := e.Next()
 			cn := e.Value.(*conn)
 			if cn.inUse {
 				break
 			}
 			if time.Since(cn.usedAt) > p.idleTimeout {
-				if err := p.Remove(cn); err != nil {
+				p.conns.Remove(e)
+				cn.elem = nil
+				p.len--
+				if err := cn.Close(); err != nil {
 					glog.Errorf("Remove failed: %s", err)
 				}
+				p.freeToken()
 			}
+			e = next
 		}
 	}
 
-	for p.conns.Len() >= p.maxSize && p.len == 0 {
-		p.cond.Wait()
+	if p.len == 0 {
+		return nil, false, nil
 	}
 
-	if p.len > 0 {
-		elem := p.conns.Front()
-		cn := elem.Value.(*conn)
-		if cn.inUse {
-			panic("pool: precondition failed")
-		}
-		cn.inUse = true
-		p.conns.MoveToBack(elem)
-		p.len--
+	elem := p.conns.Front()
+	cn := elem.Value.(*conn)
+	if cn.inUse {
+		panic("pool: precondition failed")
+	}
+	cn.inUse = true
+	p.conns.MoveToBack(elem)
+	p.len--
+	return cn, true, nil
+}
 
-		p.cond.L.Unlock()
-		return cn, false, nil
+// GetN checks out up to n conns for a batch of commands. maxSize is a
+// hard cap: if n exceeds it, or the pool saturates before it can fill
+// the full batch, GetN returns however many it managed to check out
+// rather than deadlocking a caller that could make progress with
+// fewer - but only for ErrPoolTimeout, which just means the pool is
+// busy. ctx cancellation and errPoolClosed mean the caller gave up or
+// the pool is gone, so those propagate even with a non-empty partial
+// batch; the caller decides whether to use what it has or put it back.
+// Get only returns ErrPoolTimeout when the pool has a PoolTimeout, so
+// without one GetN on a saturated pool waits on ctx for each conn.
+func (p *connPool) GetN(ctx context.Context, n int) ([]*conn, error) {
+	if n > p.maxSize {
+		n = p.maxSize
 	}
 
-	if p.conns.Len() < p.maxSize {
-		cn, err := p.New()
+	conns := make([]*conn, 0, n)
+	for len(conns) < n {
+		cn, _, err := p.Get(ctx)
 		if err != nil {
-			p.cond.L.Unlock()
-			return nil, false, err
+			if err == ErrPoolTimeout && len(conns) > 0 {
+				break
+			}
+			return conns, err
 		}
-
-		cn.inUse = true
-		cn.elem = p.conns.PushBack(cn)
-
-		p.cond.L.Unlock()
-		return cn, true, nil
+		conns = append(conns, cn)
 	}
+	return conns, nil
+}
 
-	panic("not reached")
+// PutN returns a batch of conns checked out via GetN.
+func (p *connPool) PutN(conns []*conn) {
+	for _, cn := range conns {
+		if err := p.Put(cn); err != nil {
+			glog.Errorf("redis: PutN: Put failed: %s", err)
+		}
+	}
 }
 
 func (p *connPool) Put(cn *conn) error {
 	if cn.rd.Buffered() != 0 {
 		panic("redis: attempt to put connection with buffered data")
 	}
-	p.cond.L.Lock()
+	p.mu.Lock()
 	if p.closed {
-		p.cond.L.Unlock()
+		p.mu.Unlock()
 		return errPoolClosed
 	}
+	if cn.stale {
+		p.mu.Unlock()
+		return p.Remove(cn)
+	}
 	cn.inUse = false
 	cn.usedAt = time.Now()
 	p.conns.MoveToFront(cn.elem)
 	p.len++
-	p.cond.Signal()
-	p.cond.L.Unlock()
+	p.mu.Unlock()
 	return nil
 }
 
 func (p *connPool) Remove(cn *conn) (err error) {
-	p.cond.L.Lock()
+	p.mu.Lock()
 	if p.closed {
 		// Noop, connection is already closed.
-		p.cond.L.Unlock()
+		p.mu.Unlock()
 		return nil
 	}
 	if cn != nil {
 		err = cn.Close()
 	}
+	if !cn.inUse {
+		p.len--
+	}
 	p.conns.Remove(cn.elem)
 	cn.elem = nil
-	p.cond.Signal()
-	p.cond.L.Unlock()
+	p.mu.Unlock()
+	p.freeToken()
 	return err
 }
 
 // Returns number of idle connections.
 func (p *connPool) Len() int {
-	defer p.cond.L.Unlock()
-	p.cond.L.Lock()
+	defer p.mu.Unlock()
+	p.mu.Lock()
 	return p.len
 }
 
 // Returns size of the pool.
 func (p *connPool) Size() int {
-	defer p.cond.L.Unlock()
-	p.cond.L.Lock()
+	defer p.mu.Unlock()
+	p.mu.Lock()
 	return p.conns.Len()
 }
 
 func (p *connPool) Close() error {
-	defer p.cond.L.Unlock()
-	p.cond.L.Lock()
+	defer p.mu.Unlock()
+	p.mu.Lock()
 	if p.closed {
 		return nil
 	}
 	p.closed = true
+	close(p.reaperStop)
 	var retErr error
 	for e := p.conns.Front(); e != nil; e = e.Next() {
 		cn := e.Value.(*conn)
@@ -249,7 +599,7 @@ func newSingleConnPool(pool pool, cn *conn, reusable bool) *singleConnPool {
 	}
 }
 
-func (p *singleConnPool) Get() (*conn, bool, error) {
+func (p *singleConnPool) Get(ctx context.Context) (*conn, bool, error) {
 	p.l.RLock()
 	if p.cn != nil {
 		p.l.RUnlock()
@@ -258,7 +608,7 @@ func (p *singleConnPool) Get() (*conn, bool, error) {
 	p.l.RUnlock()
 
 	p.l.Lock()
-	cn, isNew, err := p.pool.Get()
+	cn, isNew, err := p.pool.Get(ctx)
 	if err != nil {
 		p.l.Unlock()
 		return nil, false, err
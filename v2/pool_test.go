@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestPool builds a connPool whose dialer hands out one end of an
+// in-memory net.Pipe, closing the other end immediately - enough to
+// exercise Get/Put bookkeeping without a real Redis server.
+func newTestPool(maxSize int, poolTimeout time.Duration) *connPool {
+	dial := newConnFunc(func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	})
+	return newConnPool(dial, maxSize, 0, poolOptions{PoolTimeout: poolTimeout})
+}
+
+func TestPoolTimeout(t *testing.T) {
+	p := newTestPool(1, 10*time.Millisecond)
+	defer p.Close()
+
+	cn, _, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	start := time.Now()
+	if _, _, err := p.Get(context.Background()); err != ErrPoolTimeout {
+		t.Fatalf("Get on a saturated pool = %v, want ErrPoolTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Get returned after %s, want at least PoolTimeout", elapsed)
+	}
+	if stats := p.PoolStats(); stats.Timeouts != 1 {
+		t.Errorf("Timeouts = %d, want 1", stats.Timeouts)
+	}
+
+	if err := p.Put(cn); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+}
+
+func TestPoolTimeoutCtxWinsOverPoolTimeout(t *testing.T) {
+	p := newTestPool(1, time.Hour)
+	defer p.Close()
+
+	cn, _, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer p.Put(cn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := p.Get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Get with an expiring ctx = %v, want context.DeadlineExceeded", err)
+	}
+}
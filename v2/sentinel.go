@@ -0,0 +1,250 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var errNoSentinels = errors.New("redis: all sentinels unreachable")
+
+// sentinelConnPool is a connPool whose dialer discovers the current
+// master address through a set of Sentinel nodes rather than dialing a
+// single static address. It watches the sentinel +switch-master pubsub
+// channel and, on failover, evicts idle conns so the next Get() redials
+// through the new master; conns that are checked out at the time of the
+// failover are closed instead of reused on their next Put().
+type sentinelConnPool struct {
+	*connPool
+
+	sentinels   []string
+	masterName  string
+	dialTimeout time.Duration
+
+	mu       sync.Mutex
+	lastAddr string
+
+	closed chan struct{}
+}
+
+func newSentinelConnPool(
+	sentinels []string,
+	masterName string,
+	dialTimeout time.Duration,
+	maxSize int,
+	idleTimeout time.Duration,
+) *sentinelConnPool {
+	p := &sentinelConnPool{
+		sentinels:   sentinels,
+		masterName:  masterName,
+		dialTimeout: dialTimeout,
+		closed:      make(chan struct{}),
+	}
+	p.connPool = newConnPool(newConnFunc(p.dialMaster), maxSize, idleTimeout, poolOptions{})
+	go p.watch()
+	return p
+}
+
+// sentinelAddrs returns the sentinel addresses to try, starting with
+// whichever one answered last time since it is likely still reachable.
+func (p *sentinelConnPool) sentinelAddrs() []string {
+	p.mu.Lock()
+	last := p.lastAddr
+	p.mu.Unlock()
+
+	if last == "" {
+		return p.sentinels
+	}
+	addrs := make([]string, 0, len(p.sentinels))
+	addrs = append(addrs, last)
+	for _, addr := range p.sentinels {
+		if addr != last {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (p *sentinelConnPool) dialMaster() (net.Conn, error) {
+	var lastErr error
+	for _, addr := range p.sentinelAddrs() {
+		scn, err := net.DialTimeout("tcp", addr, p.dialTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		masterAddr, err := sentinelMasterAddr(scn, p.masterName)
+		scn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		mcn, err := net.DialTimeout("tcp", masterAddr, p.dialTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		ok, err := isMaster(mcn)
+		if err != nil || !ok {
+			mcn.Close()
+			if err == nil {
+				err = fmt.Errorf("redis: %s does not report role master", masterAddr)
+			}
+			lastErr = err
+			continue
+		}
+
+		p.mu.Lock()
+		p.lastAddr = addr
+		p.mu.Unlock()
+		return mcn, nil
+	}
+	if lastErr == nil {
+		lastErr = errNoSentinels
+	}
+	return nil, lastErr
+}
+
+// sentinelMasterAddr asks a sentinel for the master's address via
+// SENTINEL get-master-addr-by-name.
+func sentinelMasterAddr(cn net.Conn, name string) (string, error) {
+	if err := writeCmd(cn, "SENTINEL", "get-master-addr-by-name", name); err != nil {
+		return "", err
+	}
+	reply, err := readReply(bufio.NewReader(cn))
+	if err != nil {
+		return "", err
+	}
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) != 2 {
+		return "", fmt.Errorf("redis: unexpected SENTINEL reply: %v", reply)
+	}
+	host, _ := parts[0].(string)
+	port, _ := parts[1].(string)
+	if host == "" || port == "" {
+		return "", fmt.Errorf("redis: master %q not known to sentinel", name)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// isMaster issues ROLE and reports whether cn currently identifies as
+// a master.
+func isMaster(cn net.Conn) (bool, error) {
+	if err := writeCmd(cn, "ROLE"); err != nil {
+		return false, err
+	}
+	reply, err := readReply(bufio.NewReader(cn))
+	if err != nil {
+		return false, err
+	}
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) == 0 {
+		return false, errBadReply
+	}
+	role, _ := parts[0].(string)
+	return role == "master", nil
+}
+
+// watch subscribes to +switch-master on a sentinel and marks the pool
+// stale on every notification, reconnecting to another sentinel if the
+// subscription drops. It keeps its own cursor into p.sentinels rather
+// than always dialing sentinelAddrs()[0]: that order is headed by
+// lastAddr, which dialMaster only updates on a successful dial, so a
+// sentinel that watch can't reach but dialMaster never needs would
+// otherwise get retried forever instead of watch moving on to the rest
+// of the list.
+func (p *sentinelConnPool) watch() {
+	i := 0
+	for {
+		select {
+		case <-p.closed:
+			return
+		default:
+		}
+
+		addr := p.sentinels[i%len(p.sentinels)]
+		i++
+		if err := p.watchOnce(addr); err != nil {
+			glog.Errorf("redis: sentinel watch on %s failed: %s", addr, err)
+		}
+
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (p *sentinelConnPool) watchOnce(addr string) error {
+	cn, err := net.DialTimeout("tcp", addr, p.dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+
+	if err := writeCmd(cn, "SUBSCRIBE", "+switch-master"); err != nil {
+		return err
+	}
+	r := bufio.NewReader(cn)
+	if _, err := readReply(r); err != nil { // subscribe confirmation
+		return err
+	}
+
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) < 3 {
+			continue
+		}
+		if kind, _ := msg[0].(string); kind != "message" {
+			continue
+		}
+		glog.Infof("redis: sentinel reported master switch: %v", msg[2])
+		p.markStale()
+	}
+}
+
+// markStale evicts every idle conn so the next Get() dials a fresh one
+// through dialMaster; conns checked out right now are closed instead of
+// recycled once they come back through Put().
+func (p *sentinelConnPool) markStale() {
+	p.connPool.mu.Lock()
+	defer p.connPool.mu.Unlock()
+
+	for e := p.connPool.conns.Front(); e != nil; {
+		next := e.Next()
+		cn := e.Value.(*conn)
+		if cn.inUse {
+			cn.stale = true
+		} else {
+			if err := cn.Close(); err != nil {
+				glog.Errorf("redis: cn.Close failed: %s", err)
+			}
+			p.connPool.conns.Remove(e)
+			p.connPool.len--
+			p.connPool.freeToken()
+		}
+		e = next
+	}
+}
+
+func (p *sentinelConnPool) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return p.connPool.Close()
+}